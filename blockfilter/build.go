@@ -0,0 +1,131 @@
+// Package blockfilter builds BIP158 basic block filters for blocks fetched
+// over a bitcoind RPC connection.
+package blockfilter
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ellemouton/bip158Example/gcs"
+	"github.com/toorop/go-bitcoind"
+)
+
+const (
+	M = 784931
+	P = 19
+)
+
+// BuildBlockFilter builds the BIP158 basic filter for the given block. It
+// includes the scriptPubKey of every output (excluding OP_RETURN outputs)
+// as well as the scriptPubKey spent by every input. Prevout scripts are
+// resolved via fetcher rather than by issuing one GetRawTransaction RPC per
+// input, which is unusably slow on real blocks.
+func BuildBlockFilter(bc *bitcoind.Bitcoind, block bitcoind.Block,
+	fetcher PrevoutFetcher) (*gcs.Filter, error) {
+
+	// Fetch every transaction in the block exactly once. We need each
+	// one anyway to read its own outputs, and the same response also
+	// gives us the txids its inputs spend from, so we can hand those to
+	// the fetcher without asking it to walk the block again itself.
+	txs := make([]bitcoind.RawTransaction, len(block.Tx))
+	prevoutTxids := make(map[string]struct{})
+
+	for i, txid := range block.Tx {
+		rawTx, err := bc.GetRawTransaction(txid, true)
+		if err != nil {
+			return nil, err
+		}
+
+		tx, ok := rawTx.(bitcoind.RawTransaction)
+		if !ok {
+			return nil, fmt.Errorf("could not convert response " +
+				"to bitcoind.RawTransaction")
+		}
+
+		txs[i] = tx
+
+		// The coinbase transaction has no prevouts.
+		if i == 0 {
+			continue
+		}
+
+		for _, txIn := range tx.Vin {
+			prevoutTxids[txIn.Txid] = struct{}{}
+		}
+	}
+
+	if err := fetcher.Prefetch(prevoutTxids); err != nil {
+		return nil, err
+	}
+
+	// The list of objects we want to include in our filter. These will be
+	// every scriptPubKey being spent as well as each output's scriptPubKey.
+	// We use a map so that we can dedup any duplicate scriptPubKeys.
+	objects := make(map[string]struct{})
+
+	for i, tx := range txs {
+		// Add the scriptPubKey of each of the transaction's outputs
+		// and add those to our list of objects.
+		for _, txOut := range tx.Vout {
+			skpStr := txOut.ScriptPubKey.Hex
+
+			spk, err := hex.DecodeString(skpStr)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(spk) == 0 {
+				continue
+			}
+
+			// We don't add the output if it is an OP_RETURN.
+			if spk[0] == 0x6a {
+				continue
+			}
+
+			objects[skpStr] = struct{}{}
+		}
+
+		// We don't add the inputs of the coinbase transaction.
+		if i == 0 {
+			continue
+		}
+
+		// For each input, resolve the scriptPubKey that it is
+		// spending via the fetcher.
+		for _, txIn := range tx.Vin {
+			spk, err := fetcher.FetchScript(txIn.Txid, uint32(txIn.Vout))
+			if err != nil {
+				return nil, err
+			}
+
+			if len(spk) == 0 {
+				continue
+			}
+
+			objects[hex.EncodeToString(spk)] = struct{}{}
+		}
+	}
+
+	// BIP158 says to use the SipHash function. This is a keyed hash
+	// function. The block hash will be used as the key.
+	blockHash, err := chainhash.NewHashFromStr(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+	var key [16]byte
+	copy(key[:], blockHash.CloneBytes())
+
+	data := make([][]byte, 0, len(objects))
+	for o := range objects {
+		b, err := hex.DecodeString(o)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, b)
+	}
+
+	return gcs.BuildGCSFilter(P, M, key, data)
+}
@@ -0,0 +1,189 @@
+package blockfilter
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/toorop/go-bitcoind"
+)
+
+// OutPoint identifies a transaction output by the id of the transaction that
+// created it and its index within that transaction's output list.
+type OutPoint struct {
+	Txid string
+	Vout uint32
+}
+
+// PrevoutFetcher resolves the scriptPubKey of the outputs spent by a block's
+// inputs. Implementations may use whatever source is most efficient: the
+// block data itself, a batched RPC pipeline, or a pre-populated UTXO cache.
+type PrevoutFetcher interface {
+	// Prefetch gives the implementation a chance to resolve every
+	// prevout in txids in one pass, before FetchScript is called for
+	// each input. txids is the deduped set of txids spent by the
+	// block's inputs, already derived by the caller from transactions
+	// it fetched anyway to read their own outputs. Implementations that
+	// resolve prevouts lazily may treat this as a no-op.
+	Prefetch(txids map[string]struct{}) error
+
+	// FetchScript returns the scriptPubKey spent by the input
+	// referencing (txid, vout).
+	FetchScript(txid string, vout uint32) ([]byte, error)
+}
+
+// maxConcurrentFetches bounds the number of in-flight getrawtransaction
+// calls a BatchedRPCPrevoutFetcher will issue at once.
+const maxConcurrentFetches = 16
+
+// BatchedRPCPrevoutFetcher resolves prevouts by deduping every txid spent
+// across the whole block and fetching each one exactly once over a bounded
+// pool of concurrent getrawtransaction calls, rather than issuing one RPC
+// per input.
+type BatchedRPCPrevoutFetcher struct {
+	bc *bitcoind.Bitcoind
+
+	scripts map[OutPoint][]byte
+}
+
+// NewBatchedRPCPrevoutFetcher returns a BatchedRPCPrevoutFetcher that uses
+// bc to resolve prevouts.
+func NewBatchedRPCPrevoutFetcher(bc *bitcoind.Bitcoind) *BatchedRPCPrevoutFetcher {
+	return &BatchedRPCPrevoutFetcher{bc: bc}
+}
+
+// Prefetch fetches each of the given txids at most once, distributing the
+// work across a bounded pool of workers.
+func (f *BatchedRPCPrevoutFetcher) Prefetch(txids map[string]struct{}) error {
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, maxConcurrentFetches)
+		mu      sync.Mutex
+		scripts = make(map[OutPoint][]byte)
+		errs    = make(chan error, len(txids))
+	)
+
+	for txid := range txids {
+		wg.Add(1)
+		go func(txid string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rawTx, err := f.bc.GetRawTransaction(txid, true)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			tx, ok := rawTx.(bitcoind.RawTransaction)
+			if !ok {
+				errs <- fmt.Errorf("could not convert response " +
+					"to bitcoind.RawTransaction")
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for vout, txOut := range tx.Vout {
+				spk, err := hex.DecodeString(txOut.ScriptPubKey.Hex)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				scripts[OutPoint{Txid: txid, Vout: uint32(vout)}] = spk
+			}
+		}(txid)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	f.scripts = scripts
+
+	return nil
+}
+
+// FetchScript returns the previously prefetched scriptPubKey for the given
+// outpoint.
+func (f *BatchedRPCPrevoutFetcher) FetchScript(txid string, vout uint32) ([]byte, error) {
+	spk, ok := f.scripts[OutPoint{Txid: txid, Vout: vout}]
+	if !ok {
+		return nil, fmt.Errorf("no prefetched scriptPubKey for %s:%d",
+			txid, vout)
+	}
+
+	return spk, nil
+}
+
+// UTXOCachePrevoutFetcher resolves prevouts from an in-memory cache keyed by
+// outpoint, seeded ahead of time (e.g. by an external indexer). It never
+// talks to bitcoind.
+type UTXOCachePrevoutFetcher struct {
+	cache map[OutPoint][]byte
+}
+
+// NewUTXOCachePrevoutFetcher returns a UTXOCachePrevoutFetcher backed by the
+// given cache. The cache is used as-is and is not copied, so callers may
+// continue to seed it as new blocks are indexed.
+func NewUTXOCachePrevoutFetcher(cache map[OutPoint][]byte) *UTXOCachePrevoutFetcher {
+	return &UTXOCachePrevoutFetcher{cache: cache}
+}
+
+// Prefetch is a no-op; the cache is assumed to already be populated.
+func (f *UTXOCachePrevoutFetcher) Prefetch(_ map[string]struct{}) error {
+	return nil
+}
+
+// FetchScript returns the cached scriptPubKey for the given outpoint.
+func (f *UTXOCachePrevoutFetcher) FetchScript(txid string, vout uint32) ([]byte, error) {
+	spk, ok := f.cache[OutPoint{Txid: txid, Vout: vout}]
+	if !ok {
+		return nil, fmt.Errorf("no cached scriptPubKey for %s:%d", txid, vout)
+	}
+
+	return spk, nil
+}
+
+// VerboseBlockPrevoutFetcher resolves prevouts from the "prevout" field
+// included inline in a getblock response fetched with verbosity 2 or 3,
+// avoiding any per-transaction RPC round trips. Callers are responsible for
+// fetching the verbose block (the go-bitcoind client used elsewhere in this
+// package only wraps the default verbosity 1 getblock call) and parsing it
+// into the scripts map before Prefetch is invoked.
+type VerboseBlockPrevoutFetcher struct {
+	scripts map[OutPoint][]byte
+}
+
+// NewVerboseBlockPrevoutFetcher returns a VerboseBlockPrevoutFetcher backed
+// by prevout scripts already extracted from a verbosity 2/3 getblock
+// response.
+func NewVerboseBlockPrevoutFetcher(scripts map[OutPoint][]byte) *VerboseBlockPrevoutFetcher {
+	return &VerboseBlockPrevoutFetcher{scripts: scripts}
+}
+
+// Prefetch is a no-op; the scripts map is populated ahead of time from the
+// verbose block response.
+func (f *VerboseBlockPrevoutFetcher) Prefetch(_ map[string]struct{}) error {
+	return nil
+}
+
+// FetchScript returns the inline prevout scriptPubKey for the given
+// outpoint.
+func (f *VerboseBlockPrevoutFetcher) FetchScript(txid string, vout uint32) ([]byte, error) {
+	spk, ok := f.scripts[OutPoint{Txid: txid, Vout: vout}]
+	if !ok {
+		return nil, fmt.Errorf("no inline prevout for %s:%d", txid, vout)
+	}
+
+	return spk, nil
+}
@@ -0,0 +1,116 @@
+package gcs
+
+import "io"
+
+// bitWriter writes individual bits, MSB first, packing them into bytes as
+// it goes. It underlies the Golomb-Rice encoder and uses only integer shifts
+// and masks, never floating point.
+type bitWriter struct {
+	buf   []byte
+	cur   byte
+	nbits uint8
+}
+
+func newBitWriter() *bitWriter {
+	return &bitWriter{}
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	w.cur <<= 1
+	if bit {
+		w.cur |= 1
+	}
+
+	w.nbits++
+	if w.nbits == 8 {
+		w.buf = append(w.buf, w.cur)
+		w.cur = 0
+		w.nbits = 0
+	}
+}
+
+// WriteUnary writes q one bits followed by a terminating zero bit.
+func (w *bitWriter) WriteUnary(q uint64) {
+	for i := uint64(0); i < q; i++ {
+		w.writeBit(true)
+	}
+
+	w.writeBit(false)
+}
+
+// WriteBits writes the low n bits of r, most significant bit first.
+func (w *bitWriter) WriteBits(r uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit((r>>uint(i))&1 == 1)
+	}
+}
+
+// Bytes returns the written bits packed into bytes, zero-padded in the final
+// byte if necessary.
+func (w *bitWriter) Bytes() []byte {
+	if w.nbits == 0 {
+		return w.buf
+	}
+
+	return append(w.buf, w.cur<<(8-w.nbits))
+}
+
+// bitReader reads individual bits, MSB first, from a byte slice. It
+// underlies the Golomb-Rice decoder and uses only integer shifts and masks.
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func newBitReader(buf []byte) *bitReader {
+	return &bitReader{buf: buf}
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	byteIdx := r.pos >> 3
+	if byteIdx >= len(r.buf) {
+		return false, io.EOF
+	}
+
+	bitIdx := 7 - uint(r.pos&7)
+	r.pos++
+
+	return (r.buf[byteIdx]>>bitIdx)&1 == 1, nil
+}
+
+// ReadUnary reads one bits until it hits a terminating zero bit, returning
+// the count of one bits seen.
+func (r *bitReader) ReadUnary() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		if !bit {
+			return q, nil
+		}
+
+		q++
+	}
+}
+
+// ReadBits reads n bits, most significant bit first, and returns them as a
+// uint64.
+func (r *bitReader) ReadBits(n uint8) (uint64, error) {
+	var v uint64
+	for i := uint8(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,45 @@
+package gcs
+
+// Decoder streams the values encoded in a filter one at a time, rather than
+// decoding the whole filter into a slice up front. This lets callers such as
+// MatchAny stop reading as soon as they've found what they're looking for.
+type Decoder struct {
+	r    *bitReader
+	p    uint8
+	n    uint32
+	read uint32
+	prev uint64
+}
+
+// Decoder returns a streaming Decoder over the filter's contents.
+func (f *Filter) Decoder() *Decoder {
+	return &Decoder{
+		r: newBitReader(f.filterData),
+		p: f.p,
+		n: f.n,
+	}
+}
+
+// Next returns the next value in the filter's sorted set, and a bool
+// indicating whether a value was available. Once all N values have been
+// read, it returns (0, false, nil).
+func (d *Decoder) Next() (uint64, bool, error) {
+	if d.read >= d.n {
+		return 0, false, nil
+	}
+
+	q, err := d.r.ReadUnary()
+	if err != nil {
+		return 0, false, err
+	}
+
+	r, err := d.r.ReadBits(d.p)
+	if err != nil {
+		return 0, false, err
+	}
+
+	d.prev += q<<d.p | r
+	d.read++
+
+	return d.prev, true, nil
+}
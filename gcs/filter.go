@@ -0,0 +1,284 @@
+// Package gcs implements Golomb-Rice coded sets as described in BIP158,
+// along with the chained filter header construction used by BIP157.
+package gcs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/aead/siphash"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var (
+	// ErrNTooBig is returned when the number of elements to include in a
+	// filter exceeds what can be represented as a CompactSize-encoded
+	// uint32.
+	ErrNTooBig = errors.New("N is too big to fit in a uint32")
+
+	// ErrPTooBig is returned when the requested Golomb-Rice parameter P
+	// is too large to be valid; P must be small enough that 1<<P fits in
+	// a uint64 remainder alongside a meaningful quotient.
+	ErrPTooBig = errors.New("P is too big")
+)
+
+// Filter represents a Golomb-Rice coded set as defined in BIP158. It can be
+// built from a set of raw data elements or parsed from its serialized form,
+// and queried for membership of one or more targets.
+type Filter struct {
+	n uint32
+	p uint8
+	m uint64
+
+	// modulusNP is N*M, the range that each element is fast-reduced into
+	// before being inserted into the set.
+	modulusNP uint64
+
+	// filterData is the raw, Golomb-Rice coded bytes of the filter. It
+	// does not include the CompactSize N prefix.
+	filterData []byte
+}
+
+// BuildGCSFilter builds a new Filter from the given data elements, using the
+// provided false-positive rate parameter P and hash range parameter M. The
+// key is used to key the SipHash function used to derive each element's
+// position in the set.
+func BuildGCSFilter(P uint8, M uint64, key [16]byte,
+	data [][]byte) (*Filter, error) {
+
+	if len(data) > math.MaxUint32 {
+		return nil, ErrNTooBig
+	}
+	if P >= 32 {
+		return nil, ErrPTooBig
+	}
+
+	n := uint32(len(data))
+
+	modulusNP, err := checkedMulUint64(uint64(n), M)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make([]uint64, 0, n)
+	for _, d := range data {
+		numbers = append(numbers, convertToNumber(d, modulusNP, key))
+	}
+
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	w := newBitWriter()
+
+	var prev uint64
+	for _, num := range numbers {
+		d := num - prev
+		w.WriteUnary(d >> P)
+		w.WriteBits(d&((1<<P)-1), P)
+		prev = num
+	}
+
+	return &Filter{
+		n:          n,
+		p:          P,
+		m:          M,
+		modulusNP:  modulusNP,
+		filterData: w.Bytes(),
+	}, nil
+}
+
+// FromNBytes parses a Filter from the CompactSize-prefixed serialization
+// produced by NBytes.
+func FromNBytes(P uint8, M uint64, d []byte) (*Filter, error) {
+	buf := bytes.NewReader(d)
+
+	n, err := wire.ReadVarInt(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	filterData := make([]byte, buf.Len())
+	if _, err := io.ReadFull(buf, filterData); err != nil {
+		return nil, err
+	}
+
+	return newFilter(P, M, n, filterData)
+}
+
+// FromBytes parses a Filter from its raw Golomb-Rice coded bytes, i.e. the
+// serialization produced by Bytes. Since that serialization has no N prefix,
+// the element count N must be supplied out of band.
+func FromBytes(P uint8, M uint64, N uint32, d []byte) (*Filter, error) {
+	return newFilter(P, M, uint64(N), d)
+}
+
+func newFilter(P uint8, M uint64, n uint64, filterData []byte) (*Filter, error) {
+	if n > math.MaxUint32 {
+		return nil, ErrNTooBig
+	}
+	if P >= 32 {
+		return nil, ErrPTooBig
+	}
+
+	modulusNP, err := checkedMulUint64(n, M)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		n:          uint32(n),
+		p:          P,
+		m:          M,
+		modulusNP:  modulusNP,
+		filterData: filterData,
+	}, nil
+}
+
+// checkedMulUint64 multiplies a and b, returning an error if the result
+// overflows a uint64.
+func checkedMulUint64(a, b uint64) (uint64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+
+	result := a * b
+	if result/a != b {
+		return 0, errors.New("overflow computing N*M")
+	}
+
+	return result, nil
+}
+
+// Match returns true if the target is likely a member of the filter's
+// set. As with any probabilistic filter, a true result may be a false
+// positive, but a false result is always a true negative.
+func (f *Filter) Match(key [16]byte, target []byte) (bool, error) {
+	return f.MatchAny(key, [][]byte{target})
+}
+
+// MatchAny returns true if any of the targets are likely members of the
+// filter's set. The targets are hashed and fast-reduced into the filter's
+// range, sorted, and then compared against the filter's contents with a
+// single linear walk of the Golomb-Rice coded stream, decoded one value at a
+// time so the walk can stop as soon as a hit is found.
+func (f *Filter) MatchAny(key [16]byte, targets [][]byte) (bool, error) {
+	if len(targets) == 0 {
+		return false, nil
+	}
+
+	queries := make([]uint64, len(targets))
+	for i, target := range targets {
+		queries[i] = convertToNumber(target, f.modulusNP, key)
+	}
+	sort.Slice(queries, func(i, j int) bool { return queries[i] < queries[j] })
+
+	dec := f.Decoder()
+
+	idx := 0
+	for {
+		value, ok, err := dec.Next()
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+
+		for value >= queries[idx] {
+			if value == queries[idx] {
+				return true, nil
+			}
+
+			idx++
+			if idx == len(queries) {
+				return false, nil
+			}
+		}
+	}
+}
+
+// NBytes serializes the filter with a leading CompactSize-encoded N, the
+// number of elements in the set.
+func (f *Filter) NBytes() []byte {
+	var buf bytes.Buffer
+	buf.Grow(wire.VarIntSerializeSize(uint64(f.n)) + len(f.filterData))
+
+	_ = wire.WriteVarInt(&buf, 0, uint64(f.n))
+	buf.Write(f.filterData)
+
+	return buf.Bytes()
+}
+
+// Bytes returns the raw Golomb-Rice coded payload of the filter, without the
+// CompactSize N prefix. Pair with FromBytes to round-trip a filter when N is
+// already known out of band.
+func (f *Filter) Bytes() []byte {
+	return f.filterData
+}
+
+// Hash returns the double-SHA256 of the filter's serialized (N-prefixed)
+// form, as used in BIP157 filter header construction.
+func (f *Filter) Hash() chainhash.Hash {
+	return chainhash.DoubleHashH(f.NBytes())
+}
+
+// BuildHeader computes the chained filter header for this filter, given the
+// previous filter header in the chain. At the genesis block, prev should be
+// the zero hash.
+func (f *Filter) BuildHeader(prev chainhash.Hash) chainhash.Hash {
+	filterHash := f.Hash()
+
+	var data [2 * chainhash.HashSize]byte
+	copy(data[:chainhash.HashSize], filterHash[:])
+	copy(data[chainhash.HashSize:], prev[:])
+
+	return chainhash.DoubleHashH(data[:])
+}
+
+func convertToNumber(object []byte, modulusNP uint64, key [16]byte) uint64 {
+	nphi := modulusNP >> 32
+	nplo := uint64(uint32(modulusNP))
+
+	v := siphash.Sum64(object, &key)
+
+	return fastReduction(v, nphi, nplo)
+}
+
+// fastReduction calculates a mapping that's more ore less equivalent to: x mod
+// N. However, instead of using a mod operation, which using a non-power of two
+// will lead to slowness on many processors due to unnecessary division, we
+// instead use a "multiply-and-shift" trick which eliminates all divisions,
+// described in:
+// https://lemire.me/blog/2016/06/27/a-fast-alternative-to-the-modulo-reduction/
+//
+//  * v * N  >> log_2(N)
+//
+// In our case, using 64-bit integers, log_2 is 64. As most processors don't
+// support 128-bit arithmetic natively, we'll be super portable and unfold the
+// operation into several operations with 64-bit arithmetic. As inputs, we the
+// number to reduce, and our modulus N divided into its high 32-bits and lower
+// 32-bits.
+func fastReduction(v, nHi, nLo uint64) uint64 {
+	// First, we'll spit the item we need to reduce into its higher and
+	// lower bits.
+	vhi := v >> 32
+	vlo := uint64(uint32(v))
+
+	// Then, we distribute multiplication over each part.
+	vnphi := vhi * nHi
+	vnpmid := vhi * nLo
+	npvmid := nHi * vlo
+	vnplo := vlo * nLo
+
+	// We calculate the carry bit.
+	carry := (uint64(uint32(vnpmid)) + uint64(uint32(npvmid)) +
+		(vnplo >> 32)) >> 32
+
+	// Last, we add the high bits, the middle bits, and the carry.
+	v = vnphi + (vnpmid >> 32) + (npvmid >> 32) + carry
+
+	return v
+}
@@ -0,0 +1,116 @@
+// Package headers builds and verifies the BIP157 filter header chain on top
+// of the BIP158 basic filters produced by the blockfilter package.
+package headers
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ellemouton/bip158Example/blockfilter"
+	"github.com/ellemouton/bip158Example/gcs"
+	"github.com/toorop/go-bitcoind"
+)
+
+// BuildFilterHeaders walks the block range [start, end], building the
+// BIP158 basic filter for each block and chaining their headers together as
+// described in BIP157:
+//
+//	H_i = dblSHA256(dblSHA256(filter_i) || H_{i-1})
+//
+// prevHeader is the chained header for the block at height start-1. At
+// genesis (start == 0) callers should pass the zero hash; for any other
+// start, prevHeader must be the real header already computed for start-1,
+// e.g. from a prior call or from Store.FilterHeaders.
+func BuildFilterHeaders(bc *bitcoind.Bitcoind, start, end int64,
+	prevHeader chainhash.Hash) ([]chainhash.Hash, error) {
+
+	out := make([]chainhash.Hash, 0, end-start+1)
+
+	err := walkRange(bc, start, end, prevHeader, func(_ int64, _ chainhash.Hash,
+		_ *gcs.Filter, header chainhash.Hash) error {
+
+		out = append(out, header)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// VerifyFilterHeaders recomputes the filter header chain from the given raw
+// filters and checks that it matches the provided headers.
+func VerifyFilterHeaders(headers []chainhash.Hash, filters [][]byte) error {
+	if len(headers) != len(filters) {
+		return fmt.Errorf("got %d headers but %d filters", len(headers),
+			len(filters))
+	}
+
+	var prevHeader chainhash.Hash
+	for i, filter := range filters {
+		filterHash := chainhash.DoubleHashH(filter)
+
+		var data [2 * chainhash.HashSize]byte
+		copy(data[:chainhash.HashSize], filterHash[:])
+		copy(data[chainhash.HashSize:], prevHeader[:])
+
+		header := chainhash.DoubleHashH(data[:])
+		if header != headers[i] {
+			return fmt.Errorf("filter header mismatch at index %d: "+
+				"got %s, want %s", i, headers[i], header)
+		}
+
+		prevHeader = header
+	}
+
+	return nil
+}
+
+// walkRange fetches and filters every block in [start, end] in order,
+// chaining filter headers onto prevHeader (the header at height start-1) as
+// it goes, and invokes fn with the result for each height.
+func walkRange(bc *bitcoind.Bitcoind, start, end int64,
+	prevHeader chainhash.Hash, fn func(height int64, blockHash chainhash.Hash,
+		filter *gcs.Filter, header chainhash.Hash) error) error {
+
+	if end < start {
+		return fmt.Errorf("end height %d is before start height %d",
+			end, start)
+	}
+
+	for height := start; height <= end; height++ {
+		blockHashStr, err := bc.GetBlockHash(uint64(height))
+		if err != nil {
+			return err
+		}
+
+		block, err := bc.GetBlock(blockHashStr)
+		if err != nil {
+			return err
+		}
+
+		fetcher := blockfilter.NewBatchedRPCPrevoutFetcher(bc)
+
+		filter, err := blockfilter.BuildBlockFilter(bc, block, fetcher)
+		if err != nil {
+			return err
+		}
+
+		header := filter.BuildHeader(prevHeader)
+
+		blockHash, err := chainhash.NewHashFromStr(blockHashStr)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(height, *blockHash, filter, header); err != nil {
+			return err
+		}
+
+		prevHeader = header
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package headers
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/ellemouton/bip158Example/gcs"
+	"github.com/toorop/go-bitcoind"
+	bolt "go.etcd.io/bbolt"
+)
+
+// filterHeaderBucket holds one entry per block height, keyed by the
+// big-endian encoding of the height.
+var filterHeaderBucket = []byte("filter-headers")
+
+// Store persists the filter header chain to disk, keyed by block height, so
+// that a light-client-style caller can serve getcfheaders/getcfilters-shaped
+// queries without re-fetching and re-building filters for blocks it has
+// already processed.
+type Store struct {
+	db *bolt.DB
+}
+
+// NewStore opens (creating if necessary) a Store backed by a bbolt database
+// at the given path.
+func NewStore(dbPath string) (*Store, error) {
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filterHeaderBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// entry is the on-disk representation of a single height's filter header
+// chain data: the block hash, the filter's own hash, the chained header
+// hash, and the raw filter bytes.
+type entry struct {
+	blockHash  chainhash.Hash
+	filterHash chainhash.Hash
+	headerHash chainhash.Hash
+	filter     []byte
+}
+
+func (e *entry) serialize() []byte {
+	buf := make([]byte, 0, 3*chainhash.HashSize+len(e.filter))
+	buf = append(buf, e.blockHash[:]...)
+	buf = append(buf, e.filterHash[:]...)
+	buf = append(buf, e.headerHash[:]...)
+	buf = append(buf, e.filter...)
+
+	return buf
+}
+
+func deserializeEntry(raw []byte) (*entry, error) {
+	if len(raw) < 3*chainhash.HashSize {
+		return nil, fmt.Errorf("corrupt filter header entry: only %d bytes",
+			len(raw))
+	}
+
+	var e entry
+	copy(e.blockHash[:], raw[:chainhash.HashSize])
+	copy(e.filterHash[:], raw[chainhash.HashSize:2*chainhash.HashSize])
+	copy(e.headerHash[:], raw[2*chainhash.HashSize:3*chainhash.HashSize])
+
+	// raw is only valid for the life of the bbolt transaction it was
+	// read in, so copy the filter bytes out rather than slicing raw
+	// directly.
+	e.filter = make([]byte, len(raw)-3*chainhash.HashSize)
+	copy(e.filter, raw[3*chainhash.HashSize:])
+
+	return &e, nil
+}
+
+func heightKey(height int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+
+	return key
+}
+
+// Sync walks the block range [start, end], building and chaining the filter
+// header for each block exactly as BuildFilterHeaders does, but persists
+// every (height, blockHash, filterHash, headerHash, filter) tuple to the
+// store as it goes. This makes incremental syncing safe: if start > 0, the
+// chain is continued from the real header already stored for start-1
+// (e.g. from a prior call to Sync), rather than from the zero hash.
+func (s *Store) Sync(bc *bitcoind.Bitcoind, start, end int64) error {
+	prevHeader, err := s.prevHeader(start)
+	if err != nil {
+		return err
+	}
+
+	return walkRange(bc, start, end, prevHeader, func(height int64,
+		blockHash chainhash.Hash, filter *gcs.Filter,
+		header chainhash.Hash) error {
+
+		e := entry{
+			blockHash:  blockHash,
+			filterHash: filter.Hash(),
+			headerHash: header,
+			filter:     filter.NBytes(),
+		}
+
+		return s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(filterHeaderBucket)
+			return b.Put(heightKey(height), e.serialize())
+		})
+	})
+}
+
+// prevHeader returns the chained header for the block at height start-1, so
+// that a sync starting above genesis continues the real chain instead of
+// restarting it from the zero hash. At genesis it returns the zero hash.
+func (s *Store) prevHeader(start int64) (chainhash.Hash, error) {
+	if start == 0 {
+		return chainhash.Hash{}, nil
+	}
+
+	headers, err := s.FilterHeaders(start-1, start-1)
+	if err != nil {
+		return chainhash.Hash{}, fmt.Errorf("could not look up filter "+
+			"header for height %d, required to continue the chain "+
+			"from height %d: %w", start-1, start, err)
+	}
+
+	return headers[0], nil
+}
+
+// FilterHeaders returns the chained filter headers for the height range
+// [start, end], as would be served in response to a getcfheaders request.
+func (s *Store) FilterHeaders(start, end int64) ([]chainhash.Hash, error) {
+	if end < start {
+		return nil, fmt.Errorf("end height %d is before start height %d",
+			end, start)
+	}
+
+	out := make([]chainhash.Hash, 0, end-start+1)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filterHeaderBucket)
+
+		for height := start; height <= end; height++ {
+			raw := b.Get(heightKey(height))
+			if raw == nil {
+				return fmt.Errorf("no filter header stored for "+
+					"height %d", height)
+			}
+
+			e, err := deserializeEntry(raw)
+			if err != nil {
+				return err
+			}
+
+			out = append(out, e.headerHash)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Filters returns the raw, NBytes-serialized filter for each height in the
+// range [start, end], as would be served in response to a getcfilters
+// request.
+func (s *Store) Filters(start, end int64) ([][]byte, error) {
+	if end < start {
+		return nil, fmt.Errorf("end height %d is before start height %d",
+			end, start)
+	}
+
+	out := make([][]byte, 0, end-start+1)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filterHeaderBucket)
+
+		for height := start; height <= end; height++ {
+			raw := b.Get(heightKey(height))
+			if raw == nil {
+				return fmt.Errorf("no filter stored for height %d",
+					height)
+			}
+
+			e, err := deserializeEntry(raw)
+			if err != nil {
+				return err
+			}
+
+			out = append(out, e.filter)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}